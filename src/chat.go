@@ -3,56 +3,187 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/rand"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 
-	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
 
 	"github.com/multiformats/go-multiaddr"
 )
 
-// Handle a peer connection event. Create a buffer and listen to it for read 
-// events. Also write to it when input comes in.
-func handleStream(stream network.Stream) {
-	fmt.Println("-- Found a new stream, opening two way read-write buffer")
+// chatProtocol is the framed, signed protocol chat streams are opened on.
+// chatProtocolLegacy is kept around so older peers that only understand raw
+// newline-delimited text can still join the room; fileProtocol carries its
+// own signed offer-then-chunks envelopes for the /file command, self
+// contained on its own stream rather than relying on chatProtocol.
+const (
+	chatProtocol       = protocol.ID("/chat/1.1.0")
+	chatProtocolLegacy = protocol.ID("/chat/1.0.0")
+	fileProtocol       = protocol.ID("/chat/file/1.0.0")
+)
+
+// peerConn tracks a single connected peer's read-write buffer so writeData
+// can fan messages out to everyone we're currently talking to. writeMu
+// serializes writes to rw, since framed envelopes (chat text from writeData,
+// file-receipt acks from the fileProtocol handler) can be written from more
+// than one goroutine.
+type peerConn struct {
+	id       peer.ID
+	stream   network.Stream
+	rw       *bufio.ReadWriter
+	protocol protocol.ID
+	writeMu  sync.Mutex
+}
+
+// peers holds every currently open stream, guarded by peersMu since streams
+// can be added (new connection) or removed (peer disconnected) concurrently.
+var (
+	peersMu sync.Mutex
+	peers   = map[peer.ID]*peerConn{}
+)
+
+// preferStream reports whether stream should win over an existing
+// connection to the same peer. Both ends of a simultaneous mutual dial
+// race this independently, so picking "whichever registered first" lets
+// the two sides disagree about which of the two logical streams survives
+// -- each resets the other's surviving stream, and the link drops
+// entirely. Instead, both sides apply the same rule from facts they each
+// already know (who's being dialed and who's dialing): the peer with the
+// lexicographically lower ID always keeps its outbound stream, so both
+// ends independently converge on the same winning connection.
+func preferStream(local, remote peer.ID, stream network.Stream) bool {
+	outbound := stream.Stat().Direction == network.DirOutbound
+	localIsLower := local < remote
+	return outbound == localIsLower
+}
+
+// addPeer registers a newly opened stream, unless we already have a live
+// connection to this peer -- multiple discovery paths (mutual mDNS dials,
+// -dest plus mDNS, rendezvous plus mDNS, ...) routinely end up dialing the
+// same peer twice, and the check-then-dial guards callers do before opening
+// a stream can't prevent that race. preferStream decides which of the two
+// survives; the other is reset instead of being left to overwrite (or be
+// overwritten by) the live one. It then blocks reading until the peer
+// disconnects, and only removes itself from peers if it's still the
+// registered connection for that peer, so a redundant stream closing late
+// doesn't evict a newer one that replaced it.
+func addPeer(h host.Host, id peer.ID, stream network.Stream, proto protocol.ID) {
+	p := &peerConn{id: id, stream: stream, rw: bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream)), protocol: proto}
+
+	peersMu.Lock()
+	existing, duplicate := peers[id]
+	if duplicate && !preferStream(h.ID(), id, stream) {
+		peersMu.Unlock()
+		fmt.Printf("-- Already connected to peer %s, closing duplicate stream\n", id.Pretty()[:12])
+		stream.Reset()
+		return
+	}
+	peers[id] = p
+	peersMu.Unlock()
 
-	// Create a buffer stream for non blocking read and write.
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	if duplicate {
+		fmt.Printf("-- Replacing duplicate connection to peer %s\n", id.Pretty()[:12])
+		existing.stream.Reset()
+	}
+
+	fmt.Printf("-- Connected to peer %s on %s\n", id.Pretty()[:12], proto)
+
+	readData(h, p)
 
-	fmt.Println("-- Created buffer, now listening infinetly for reads and writes")
+	peersMu.Lock()
+	if peers[id] == p {
+		delete(peers, id)
+	}
+	peersMu.Unlock()
 
-	go readData(rw)
-	go writeData(rw)
+	fmt.Printf("-- Disconnected from peer %s\n", id.Pretty()[:12])
+}
+
+// Handle a peer connection event. Create a buffer and listen to it for read
+// events. Also write to it when input comes in.
+func handleStream(h host.Host, stream network.Stream) {
+	fmt.Println("-- Found a new stream, opening two way read-write buffer")
+
+	go addPeer(h, stream.Conn().RemotePeer(), stream, stream.Protocol())
 
 	// The stream will stay open until you close it (or the other side closes it).
 }
 
-// Read data from the buffer connected to the other peer.
-func readData(rw *bufio.ReadWriter) {
+// readData dispatches to the framed or legacy reader depending on which
+// protocol this peer's stream was opened on.
+func readData(h host.Host, p *peerConn) {
+	if p.protocol == chatProtocolLegacy {
+		readLegacyText(p)
+		return
+	}
+	readFramed(h, p)
+}
+
+// readLegacyText reads raw newline-delimited text, as chatProtocolLegacy
+// peers still send it.
+func readLegacyText(p *peerConn) {
+	tag := p.id.Pretty()[:12]
+
 	for {
 		// Don't print out empty messages
-		str, _ := rw.ReadString('\n')
+		str, err := p.rw.ReadString('\n')
 
-		if str == "" {
+		if str == "" || err != nil {
 			return
 		}
-		
+
 		if str != "\n" {
 			// Peers' messages appear in green, ours in white
-			fmt.Printf("\x1b[32m%s\x1b[0m$> ", str)
+			fmt.Printf("\x1b[32m%s: %s\x1b[0m$> ", tag, str)
+		}
+	}
+}
+
+// readFramed reads signed envelopes from a chatProtocol peer, verifying each
+// one was genuinely signed by that peer before acting on it.
+func readFramed(h host.Host, p *peerConn) {
+	tag := p.id.Pretty()[:12]
+
+	for {
+		e, err := readEnvelope(p.rw.Reader)
+		if err != nil {
+			return
 		}
 
+		pubKey := h.Peerstore().PubKey(p.id)
+		if pubKey == nil {
+			fmt.Printf("!! No known public key for %s, dropping message\n", tag)
+			continue
+		}
+		if err := verifyEnvelope(e, p.id, pubKey); err != nil {
+			fmt.Printf("!! Dropping unverifiable message from %s: %s\n", tag, err)
+			continue
+		}
+
+		switch e.Kind {
+		case kindText:
+			// Peers' messages appear in green, ours in white
+			fmt.Printf("\x1b[32m%s: %s\x1b[0m$> ", tag, e.Payload)
+		case kindAck:
+			fmt.Printf("\n-- %s acked receipt of %q\n$> ", tag, e.Payload)
+		}
 	}
 }
 
-// Write data to the peer.
-func writeData(rw *bufio.ReadWriter) {
+// writeData reads lines from stdin and sends them out: a line starting with
+// "/file " always triggers a direct file transfer; otherwise, if tc is set,
+// the line is published to the pubsub topic instead of being fanned out to
+// the directly connected peers.
+func writeData(h host.Host, privKey crypto.PrivKey, tc *topicChat) {
 	// Terminal input reader
 	stdReader := bufio.NewReader(os.Stdin)
 
@@ -63,23 +194,106 @@ func writeData(rw *bufio.ReadWriter) {
 
 		// Read input until the user hits enter
 		sendData, err := stdReader.ReadString('\n')
-		if err != nil {	
+		if err != nil {
 			fmt.Println("!! Error reading input from stdin")
 			panic(err)
 		}
 
-		// Write it to the buffer
-		rw.WriteString(fmt.Sprintf("%s\n", sendData))
-		// Flush the buffer to ensure all data gets passed
-		rw.Flush()
+		if path := strings.TrimPrefix(sendData, "/file "); path != sendData {
+			sendFile(h, privKey, strings.TrimSpace(path))
+			continue
+		}
+
+		if tc != nil {
+			if err := tc.publish(context.Background(), []byte(strings.TrimRight(sendData, "\n"))); err != nil {
+				fmt.Printf("!! Failed to publish to topic: %s\n", err)
+			}
+			continue
+		}
+
+		peersMu.Lock()
+		targets := make([]*peerConn, 0, len(peers))
+		for _, p := range peers {
+			targets = append(targets, p)
+		}
+		peersMu.Unlock()
+
+		for _, p := range targets {
+			if p.protocol == chatProtocolLegacy {
+				p.writeMu.Lock()
+				p.rw.WriteString(fmt.Sprintf("%s\n", sendData))
+				p.rw.Flush()
+				p.writeMu.Unlock()
+				continue
+			}
+
+			e, err := newEnvelope(h.ID(), privKey, kindText, []byte(strings.TrimRight(sendData, "\n")))
+			if err != nil {
+				fmt.Printf("!! Failed to sign message for %s: %s\n", p.id.Pretty()[:12], err)
+				continue
+			}
+
+			p.writeMu.Lock()
+			err = writeEnvelope(p.rw.Writer, e)
+			p.writeMu.Unlock()
+			if err != nil {
+				fmt.Printf("!! Failed to send message to %s: %s\n", p.id.Pretty()[:12], err)
+			}
+		}
+	}
+
+}
+
+// discoveryNotifee gets notified by the mDNS service whenever it finds a new
+// peer advertising the same service tag, and auto-dials it on chatProtocol.
+type discoveryNotifee struct {
+	h host.Host
+}
+
+// HandlePeerFound connects to a newly discovered peer and opens a chat stream.
+func (n *discoveryNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	if pi.ID == n.h.ID() {
+		return
 	}
 
+	peersMu.Lock()
+	_, alreadyConnected := peers[pi.ID]
+	peersMu.Unlock()
+	if alreadyConnected {
+		return
+	}
+
+	fmt.Printf("-- Discovered peer %s via mDNS, dialing\n", pi.ID.Pretty()[:12])
+
+	n.h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.PermanentAddrTTL)
+
+	s, err := n.h.NewStream(context.Background(), pi.ID, chatProtocol, chatProtocolLegacy)
+	if err != nil {
+		fmt.Printf("!! Failed to dial discovered peer %s: %s\n", pi.ID.Pretty()[:12], err)
+		return
+	}
+
+	go addPeer(n.h, pi.ID, s, s.Protocol())
+}
+
+// startDiscovery starts the mDNS discovery service advertising and searching
+// for peers under the given service tag, so peers on the same LAN can find
+// each other without exchanging multiaddrs by hand.
+func startDiscovery(h host.Host, serviceTag string) error {
+	svc := mdns.NewMdnsService(h, serviceTag, &discoveryNotifee{h: h})
+	return svc.Start()
 }
 
 func main() {
 	// Define the flags for this program
 	port := flag.Int("port", 0, "Port number")
 	dest := flag.String("dest", "", "Destination multiaddr string")
+	service := flag.String("service", "chat-direct", "mDNS service tag; peers using the same tag will discover each other")
+	rendezvous := flag.String("rendezvous", "", "Rendezvous string; when set, finds peers via the IPFS DHT instead of requiring a -dest multiaddr")
+	seed := flag.Int64("seed", 0, "Seed for deterministic peer ID generation; 0 uses crypto/rand for a random ID")
+	identity := flag.String("identity", "", "Path to load/save this node's private key, so it keeps a stable peer ID across runs")
+	downloadDir := flag.String("download-dir", ".", "Directory incoming /file transfers are saved to")
+	topic := flag.String("topic", "", "Pubsub topic name; when set, stdin is published to this gossipsub topic instead of direct peer streams")
 	help := flag.Bool("help", false, "Display help")
 
 	flag.Parse()
@@ -88,69 +302,84 @@ func main() {
 		fmt.Println("-- This program demonstrates a simple p2p chat application using libp2p\n")
 		fmt.Println("-- Usage: Run './chat -port <PORT>' where <PORT> can be any port number, e.g., 6666 or 8888, etc.")
 		fmt.Println("-- Now run './chat -dest <MULTIADDR>' where <MULTIADDR> is multiaddress of previous listener host.")
+		fmt.Println("-- Or skip -dest entirely and rely on '-service <TAG>' mDNS discovery to find other peers on the LAN.")
+		fmt.Println("-- Once connected, type '/file <path>' instead of a chat message to send a file to every connected peer.")
 
 		os.Exit(0)
 	}
 
-	// Generate a random peer Id. This will be used to identify ourself and to 
-	// generate our private key.
-	peerId := rand.Reader
-	fmt.Println("-- Got peer ID")
+	ctx := context.Background()
 
-	// Creates a new RSA key pair for this host.
-	privateKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, peerId)
+	// makeHost loads our identity from disk if -identity points at a saved
+	// key (otherwise generating a fresh RSA key pair, deterministically
+	// when -seed is non-zero and saving it there for next time) and uses it
+	// to construct a listening host, adding NAT traversal options when
+	// rendezvous mode is requested since peers found via the DHT are often
+	// not directly dialable otherwise.
+	h, privateKey, err := makeHost(ctx, *port, *seed, *identity, *rendezvous != "")
 	if err != nil {
-		fmt.Println("!! Error generating RSA key pair")
+		fmt.Println("!! Error creating host object")
 		panic(err)
 	}
-	fmt.Println("-- Created RSA key pair")
+	fmt.Println("-- Created host object")
 
-	// Our mutli address on the IPFS protocol
-	// 0.0.0.0 will listen on any interface device.
-	sourceMultiAddr, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", *port))
+	if *rendezvous != "" {
+		h, err = setupRendezvousHost(ctx, h, *rendezvous)
+		if err != nil {
+			fmt.Println("!! Error setting up rendezvous/DHT host")
+			panic(err)
+		}
+	}
 
-	// Construct a new Host object that will allow us to connect to and initiate connections to other peers
-	host, err := libp2p.New(
-		context.Background(),
-		libp2p.ListenAddrs(sourceMultiAddr),
-		libp2p.Identity(privateKey),
-	)
-	if err != nil {
-		fmt.Println("!! Error creating host object")
+	if err := os.MkdirAll(*downloadDir, 0755); err != nil {
+		fmt.Println("!! Error creating download directory")
 		panic(err)
 	}
-	fmt.Println("-- Creating host object")
 
-	// If the destination is not specified, then we are going to initiate the connection.
-	if *dest == "" {
-		// Set a function as stream handler.
-		// This function is called when a peer connects, and starts a stream with this protocol.
-		// Only applies on the receiving side.
-		host.SetStreamHandler("/chat/1.0.0", handleStream)
-
-		// Let's get the actual TCP port from our listen multiaddr, in case we're using 0 (default; random available port).
-		var port string
-		for _, la := range host.Network().ListenAddresses() {
-			if p, err := la.ValueForProtocol(multiaddr.P_TCP); err == nil {
-				port = p
-				break
-			}
-		}
+	// Set a function as stream handler for both the framed protocol and the
+	// legacy raw-text one, so older peers can still join the room.
+	// This function is called when a peer connects, and starts a stream with this protocol.
+	h.SetStreamHandler(chatProtocol, func(stream network.Stream) { handleStream(h, stream) })
+	h.SetStreamHandler(chatProtocolLegacy, func(stream network.Stream) { handleStream(h, stream) })
+	h.SetStreamHandler(fileProtocol, handleFileStream(h, privateKey, *downloadDir))
 
-		if port == "" {
-			fmt.Printf("!! Unable to find local port %s\n", port)
-			panic("Unable to find actual local port")
+	if err := startDiscovery(h, *service); err != nil {
+		fmt.Println("!! Error starting mDNS discovery")
+		panic(err)
+	}
+	fmt.Printf("-- Started mDNS discovery on service tag %q\n", *service)
+
+	// Joining a pubsub topic runs alongside direct chatProtocol connections
+	// on the same host; only stdin input picks one or the other.
+	var tc *topicChat
+	if *topic != "" {
+		tc, err = joinTopic(ctx, h, *topic)
+		if err != nil {
+			fmt.Println("!! Error joining pubsub topic")
+			panic(err)
 		}
+		fmt.Printf("-- Joined pubsub topic %q\n", *topic)
+	}
 
-		// Wait for a connection.
-		fmt.Printf("-- This node's multiaddr is /ip4/127.0.0.1/tcp/%v/p2p/%s. To connect to it, run another node and specify this address with the dest option.\n", port, host.ID().Pretty())
+	// A single writer fans out stdin to every peer we're connected to,
+	// whether they were dialed directly or discovered via mDNS, or publishes
+	// it to the pubsub topic instead when -topic is set.
+	go writeData(h, privateKey, tc)
 
-		// Hang forever. When the other peer tries to make a connection, then the 
-		// handleStream function will take over.
+	// If the destination is not specified, then we rely on discovery (or
+	// incoming connections) to populate our peer set.
+	if *dest == "" {
+		fmt.Printf("-- This node's peer ID is %s. To connect to it, run another node with -dest set to one of:\n", h.ID().Pretty())
+		for _, la := range h.Addrs() {
+			fmt.Printf(" - %s/p2p/%s\n", la, h.ID().Pretty())
+		}
+
+		// Hang forever. Incoming connections are handled by handleStream, and
+		// discovered peers are dialed by discoveryNotifee.
 		<-make(chan struct{})
 	} else {
 		fmt.Println("-- This node's multiaddrs are:")
-		for _, la := range host.Addrs() {
+		for _, la := range h.Addrs() {
 			fmt.Printf(" - %v\n", la)
 		}
 		fmt.Println()
@@ -173,23 +402,19 @@ func main() {
 
 		// Add the destination's peer multiaddress in the peerstore.
 		// This will be used during connection and stream creation by libp2p.
-		host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
+		h.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
 
-		// Start a stream with the destination.
-		// Multiaddress of the destination peer is fetched from the peerstore using 'peerId'.
-		s, err := host.NewStream(context.Background(), info.ID, "/chat/1.0.0")
+		// Start a stream with the destination, preferring the framed protocol
+		// but falling back to the legacy one if that's all the peer speaks.
+		// Multiaddress of the destination peer is fetched from the peerstore using 'info.ID'.
+		s, err := h.NewStream(ctx, info.ID, chatProtocol, chatProtocolLegacy)
 		if err != nil {
 			fmt.Println("!! Failed to initiate stream with host")
 			panic(err)
 		}
 		fmt.Println("-- Initiated stream with host.")
 
-		// Create a buffered stream so that read and writes are non blocking.
-		rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
-
-		// Create a thread to read and write data.
-		go writeData(rw)
-		go readData(rw)
+		go addPeer(h, info.ID, s, s.Protocol())
 
 		// Hang forever.
 		select {}
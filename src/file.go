@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// fileChunkSize is how much of the file each kindFileChunk envelope carries.
+const fileChunkSize = 32 * 1024
+
+// fileOffer is the payload of the kindFileOffer envelope that opens every
+// fileProtocol stream, announcing the name and size of the chunks that
+// follow on that same stream.
+type fileOffer struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// sendFile streams path to every connected peer in turn, each over its own
+// fileProtocol stream: a signed kindFileOffer envelope naming the file,
+// followed by its contents as a series of signed kindFileChunk envelopes.
+// Offer and chunks travel on the same stream they're read from, so there's
+// no cross-stream timing to get wrong, and the file is reopened per peer so
+// one peer's failed transfer can't affect what the next peer receives.
+func sendFile(h host.Host, privKey crypto.PrivKey, path string) {
+	peersMu.Lock()
+	targets := make([]peer.ID, 0, len(peers))
+	for id := range peers {
+		targets = append(targets, id)
+	}
+	peersMu.Unlock()
+
+	for _, id := range targets {
+		if err := streamFileTo(h, privKey, id, path); err != nil {
+			fmt.Printf("!! Failed to send %q to %s: %s\n", path, id.Pretty()[:12], err)
+			continue
+		}
+		fmt.Printf("-- Sent %q to %s\n", path, id.Pretty()[:12])
+	}
+}
+
+// streamFileTo opens path and a dedicated fileProtocol stream to id, then
+// writes a kindFileOffer envelope followed by path's contents as a series
+// of kindFileChunk envelopes.
+func streamFileTo(h host.Host, privKey crypto.PrivKey, id peer.ID, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	s, err := h.NewStream(context.Background(), id, fileProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	w := bufio.NewWriter(s)
+
+	offerPayload, err := json.Marshal(fileOffer{Name: filepath.Base(path), Size: info.Size()})
+	if err != nil {
+		return err
+	}
+	offer, err := newEnvelope(h.ID(), privKey, kindFileOffer, offerPayload)
+	if err != nil {
+		return err
+	}
+	if err := writeEnvelope(w, offer); err != nil {
+		return err
+	}
+
+	buf := make([]byte, fileChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			chunk, err := newEnvelope(h.ID(), privKey, kindFileChunk, buf[:n])
+			if err != nil {
+				return err
+			}
+			if err := writeEnvelope(w, chunk); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleFileStream returns the fileProtocol stream handler for the
+// receiving end: it reads the kindFileOffer envelope that opens the stream,
+// creates the file it names, then appends every kindFileChunk envelope that
+// follows until the sender closes the stream, and acks receipt over the
+// chat stream if one is still open.
+func handleFileStream(h host.Host, privKey crypto.PrivKey, downloadDir string) func(network.Stream) {
+	return func(stream network.Stream) {
+		defer stream.Close()
+
+		remote := stream.Conn().RemotePeer()
+		tag := remote.Pretty()[:12]
+
+		pubKey := h.Peerstore().PubKey(remote)
+		if pubKey == nil {
+			fmt.Printf("!! No known public key for %s, dropping file transfer\n", tag)
+			return
+		}
+
+		r := bufio.NewReader(stream)
+
+		offerEnvelope, err := readEnvelope(r)
+		if err != nil {
+			fmt.Printf("!! Failed to read file offer from %s: %s\n", tag, err)
+			return
+		}
+		if err := verifyEnvelope(offerEnvelope, remote, pubKey); err != nil {
+			fmt.Printf("!! Dropping unverifiable file offer from %s: %s\n", tag, err)
+			return
+		}
+		if offerEnvelope.Kind != kindFileOffer {
+			fmt.Printf("!! Expected a file offer from %s, got %q\n", tag, offerEnvelope.Kind)
+			return
+		}
+
+		var offer fileOffer
+		if err := json.Unmarshal(offerEnvelope.Payload, &offer); err != nil {
+			fmt.Printf("!! Malformed file offer from %s: %s\n", tag, err)
+			return
+		}
+
+		destPath := filepath.Join(downloadDir, filepath.Base(offer.Name))
+		out, err := os.Create(destPath)
+		if err != nil {
+			fmt.Printf("!! Failed to create download %q: %s\n", destPath, err)
+			return
+		}
+		defer out.Close()
+
+		var received int64
+		for {
+			e, err := readEnvelope(r)
+			if err != nil {
+				break
+			}
+			if err := verifyEnvelope(e, remote, pubKey); err != nil {
+				fmt.Printf("!! Dropping unverifiable file chunk from %s: %s\n", tag, err)
+				continue
+			}
+			if e.Kind != kindFileChunk {
+				continue
+			}
+			n, err := out.Write(e.Payload)
+			received += int64(n)
+			if err != nil {
+				fmt.Printf("!! Failed to write to %q: %s\n", destPath, err)
+				return
+			}
+		}
+
+		fmt.Printf("\n-- Received %q (%d bytes) from %s, saved to %q\n$> ", offer.Name, received, tag, destPath)
+
+		ackFileReceipt(h, privKey, remote, offer.Name)
+	}
+}
+
+// ackFileReceipt sends a kindAck envelope back to from over its still-open
+// chat stream, if there is one.
+func ackFileReceipt(h host.Host, privKey crypto.PrivKey, from peer.ID, fileName string) {
+	peersMu.Lock()
+	p, ok := peers[from]
+	peersMu.Unlock()
+	if !ok || p.protocol != chatProtocol {
+		return
+	}
+
+	ack, err := newEnvelope(h.ID(), privKey, kindAck, []byte(fileName))
+	if err != nil {
+		return
+	}
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	if err := writeEnvelope(p.rw.Writer, ack); err != nil {
+		fmt.Printf("!! Failed to ack file receipt to %s: %s\n", from.Pretty()[:12], err)
+	}
+}
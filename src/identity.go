@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"os"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// identityReader returns the entropy source used to generate this node's RSA
+// keypair: crypto/rand for a fresh, unpredictable peer ID each run, or a
+// math/rand source seeded by seed so the resulting peer ID is reproducible
+// across runs (handy for scripting two peers that always have the same IDs).
+func identityReader(seed int64) io.Reader {
+	if seed == 0 {
+		return rand.Reader
+	}
+	return mrand.New(mrand.NewSource(seed))
+}
+
+// loadOrCreateIdentity loads a previously saved private key from identityPath
+// if one exists there, otherwise it generates a fresh RSA keypair (using
+// identityReader) and, if identityPath is set, persists it so the node keeps
+// the same peer ID the next time it's started with the same path.
+func loadOrCreateIdentity(identityPath string, seed int64) (crypto.PrivKey, error) {
+	if identityPath != "" {
+		data, err := ioutil.ReadFile(identityPath)
+		if err == nil {
+			return crypto.UnmarshalPrivateKey(data)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	privateKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, identityReader(seed))
+	if err != nil {
+		return nil, err
+	}
+
+	if identityPath != "" {
+		data, err := crypto.MarshalPrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(identityPath, data, 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	return privateKey, nil
+}
+
+// makeHost loads or creates this node's identity (see loadOrCreateIdentity)
+// and constructs a libp2p host listening on port, adding the extra NAT
+// traversal options peers found via DHT rendezvous need to be dialable
+// when natTraversal is set. It returns the host alongside the private key,
+// since callers still need the key to sign framed envelopes.
+func makeHost(ctx context.Context, port int, seed int64, identityPath string, natTraversal bool) (host.Host, crypto.PrivKey, error) {
+	privateKey, err := loadOrCreateIdentity(identityPath, seed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 0.0.0.0 will listen on any interface device.
+	sourceMultiAddr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := []libp2p.Option{
+		libp2p.ListenAddrs(sourceMultiAddr),
+		libp2p.Identity(privateKey),
+	}
+	if natTraversal {
+		opts = append(opts,
+			libp2p.NATPortMap(),
+			libp2p.EnableAutoRelay(),
+			libp2p.EnableHolePunching(),
+		)
+	}
+
+	h, err := libp2p.New(ctx, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return h, privateKey, nil
+}
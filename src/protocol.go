@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// envelopeKind identifies what a framed message carries.
+type envelopeKind string
+
+const (
+	kindText      envelopeKind = "text"
+	kindFileOffer envelopeKind = "file-offer"
+	kindFileChunk envelopeKind = "file-chunk"
+	kindAck       envelopeKind = "ack"
+)
+
+// maxFrameSize bounds the length prefix readEnvelope will honor. Without a
+// cap, a peer can send a frame claiming any uvarint length up to 2^64-1 and
+// make us allocate a multi-GB buffer (or panic with "makeslice: len out of
+// range") before we've even read the bytes, let alone verified them. It's
+// comfortably above the largest legitimate payload (a file chunk plus JSON
+// overhead) without letting a hostile peer size the allocation.
+const maxFrameSize = fileChunkSize + 64*1024
+
+// envelope is the framed, signed unit of communication exchanged on
+// chatProtocol. Signature covers every other field, so readFramed can verify
+// that a message genuinely came from the peer the stream claims to be with,
+// rather than trusting the stream alone.
+type envelope struct {
+	From      peer.ID      `json:"from"`
+	Timestamp int64        `json:"timestamp"`
+	Kind      envelopeKind `json:"kind"`
+	Payload   []byte       `json:"payload"`
+	Signature []byte       `json:"signature"`
+}
+
+// signingBytes returns the deterministic encoding of e that gets signed and
+// later re-verified. It excludes Signature itself.
+func (e *envelope) signingBytes() []byte {
+	buf, _ := json.Marshal(struct {
+		From      peer.ID      `json:"from"`
+		Timestamp int64        `json:"timestamp"`
+		Kind      envelopeKind `json:"kind"`
+		Payload   []byte       `json:"payload"`
+	}{e.From, e.Timestamp, e.Kind, e.Payload})
+	return buf
+}
+
+// newEnvelope builds and signs an envelope as being sent from self, using
+// self's private key.
+func newEnvelope(self peer.ID, key crypto.PrivKey, kind envelopeKind, payload []byte) (*envelope, error) {
+	e := &envelope{From: self, Timestamp: time.Now().Unix(), Kind: kind, Payload: payload}
+
+	sig, err := key.Sign(e.signingBytes())
+	if err != nil {
+		return nil, err
+	}
+	e.Signature = sig
+
+	return e, nil
+}
+
+// writeEnvelope frames e as <uvarint length><json> and flushes it to w.
+func writeEnvelope(w *bufio.Writer, e *envelope) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lenBuf, uint64(len(data)))
+
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// readEnvelope reads one <uvarint length><json> frame from r.
+func readEnvelope(r *bufio.Reader) (*envelope, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxFrameSize {
+		return nil, fmt.Errorf("envelope frame of %d bytes exceeds maxFrameSize (%d)", length, maxFrameSize)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// verifyEnvelope checks that e claims to be from remote and really was
+// signed by remote's key, so a peer can't forge messages on behalf of
+// someone else over a stream it controls.
+func verifyEnvelope(e *envelope, remote peer.ID, remoteKey crypto.PubKey) error {
+	if e.From != remote {
+		return fmt.Errorf("envelope claims to be from %s but stream is from %s", e.From.Pretty(), remote.Pretty())
+	}
+
+	sig := e.Signature
+	e.Signature = nil
+	ok, err := remoteKey.Verify(e.signingBytes(), sig)
+	e.Signature = sig
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("signature verification failed for envelope from %s", remote.Pretty())
+	}
+
+	return nil
+}
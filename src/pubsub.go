@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// topicChat wraps a joined gossipsub topic. When one is active, writeData
+// publishes stdin lines to it instead of writing them to the direct
+// chatProtocol streams, turning the room into a scalable many-to-many topic
+// instead of a set of 1:1 connections.
+type topicChat struct {
+	topic *pubsub.Topic
+	sub   *pubsub.Subscription
+	self  peer.ID
+}
+
+// joinTopic starts gossipsub on h, joins topicName and subscribes to it,
+// returning a topicChat ready to publish to.
+func joinTopic(ctx context.Context, h host.Host, topicName string) (*topicChat, error) {
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	topic, err := ps.Join(topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &topicChat{topic: topic, sub: sub, self: h.ID()}
+	go tc.readLoop(ctx)
+
+	return tc, nil
+}
+
+// publish sends data to everyone currently subscribed to the topic.
+func (tc *topicChat) publish(ctx context.Context, data []byte) error {
+	return tc.topic.Publish(ctx, data)
+}
+
+// readLoop prints every message published to the topic by someone else,
+// tagged with their short peer ID just like direct chat messages and shown
+// in a color derived from that peer ID.
+func (tc *topicChat) readLoop(ctx context.Context) {
+	for {
+		msg, err := tc.sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		// ReceivedFrom is the peer that forwarded the message to us, not its
+		// original author -- in a multi-hop mesh those differ, so use
+		// GetFrom() (the signed author field) for both the self-filter and
+		// the displayed tag.
+		author := msg.GetFrom()
+		if author == tc.self {
+			continue
+		}
+
+		tag := author.Pretty()[:12]
+		// Each author gets a stable ANSI color (31-36) from their peer ID, so
+		// different senders are easy to tell apart.
+		sum := 0
+		for _, b := range []byte(author) {
+			sum += int(b)
+		}
+		color := 31 + sum%6
+		fmt.Printf("\x1b[%dm[%s] %s: %s\x1b[0m\n$> ", color, tc.topic.String(), tag, msg.Data)
+	}
+}
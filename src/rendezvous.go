@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	discoveryrouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	discoveryutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
+	routedhost "github.com/libp2p/go-libp2p/p2p/host/routed"
+)
+
+// rendezvousPollInterval is how often we re-query the DHT for peers
+// advertising the rendezvous string, since peers may join after we start.
+const rendezvousPollInterval = time.Minute
+
+// setupRendezvousHost wraps h in a routed.RoutedHost backed by a Kademlia
+// DHT, bootstraps it against the standard IPFS bootstrap peers, and
+// advertises/discovers peers under rendezvous so two nodes can find each
+// other by name alone instead of exchanging multiaddrs.
+func setupRendezvousHost(ctx context.Context, h host.Host, rendezvous string) (host.Host, error) {
+	kadDHT, err := dht.New(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := kadDHT.Bootstrap(ctx); err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range dht.DefaultBootstrapPeers {
+		pi, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer wg.Done()
+			if err := h.Connect(ctx, pi); err != nil {
+				fmt.Printf("!! Failed to connect to bootstrap peer %s: %s\n", pi.ID.Pretty()[:12], err)
+			}
+		}(*pi)
+	}
+	wg.Wait()
+	fmt.Println("-- Bootstrapped DHT against the default IPFS bootstrap peers")
+
+	routedHost := routedhost.Wrap(h, kadDHT)
+
+	// discoveryutil.Advertise re-advertises in the background for as long as
+	// ctx lives, honoring the TTL the DHT hands back each time, so we stay
+	// discoverable past a single provider record's expiry.
+	routingDiscovery := discoveryrouting.NewRoutingDiscovery(kadDHT)
+	discoveryutil.Advertise(ctx, routingDiscovery, rendezvous)
+	fmt.Printf("-- Advertising ourselves under rendezvous %q\n", rendezvous)
+
+	go findRendezvousPeers(ctx, routedHost, routingDiscovery, rendezvous)
+
+	return routedHost, nil
+}
+
+// findRendezvousPeers periodically asks the DHT for peers advertising
+// rendezvous and dials any we don't already have an open stream with.
+func findRendezvousPeers(ctx context.Context, h host.Host, routingDiscovery *discoveryrouting.RoutingDiscovery, rendezvous string) {
+	for {
+		peerChan, err := routingDiscovery.FindPeers(ctx, rendezvous)
+		if err != nil {
+			// Transient DHT lookup errors shouldn't kill discovery for the
+			// rest of the process's life -- log and retry on the next poll.
+			fmt.Printf("!! Error finding peers via rendezvous, will retry: %s\n", err)
+			time.Sleep(rendezvousPollInterval)
+			continue
+		}
+
+		for pi := range peerChan {
+			if pi.ID == h.ID() || len(pi.Addrs) == 0 {
+				continue
+			}
+
+			peersMu.Lock()
+			_, alreadyConnected := peers[pi.ID]
+			peersMu.Unlock()
+			if alreadyConnected {
+				continue
+			}
+
+			fmt.Printf("-- Found peer %s via rendezvous, dialing\n", pi.ID.Pretty()[:12])
+
+			s, err := h.NewStream(ctx, pi.ID, chatProtocol, chatProtocolLegacy)
+			if err != nil {
+				fmt.Printf("!! Failed to dial rendezvous peer %s: %s\n", pi.ID.Pretty()[:12], err)
+				continue
+			}
+
+			go addPeer(h, pi.ID, s, s.Protocol())
+		}
+
+		time.Sleep(rendezvousPollInterval)
+	}
+}